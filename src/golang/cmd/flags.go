@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// listCacheRequested is set by the --list-cache flag; callers check it after
+// fs.Parse and, if true, typically call PrintCacheList and exit before
+// attempting any install.
+var listCacheRequested bool
+
+// RegisterFlags wires --no-verify, --progress, --refresh, --offline, and
+// --list-cache to the package-level toggles they control.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&NoVerify, "no-verify", NoVerify, "skip checksum verification of downloaded archives")
+	fs.BoolVar(&ShowProgress, "progress", ShowProgress, "show a progress indicator while downloading archives")
+	fs.BoolVar(&Refresh, "refresh", Refresh, "force re-download of archives even if a cached copy exists")
+	fs.BoolVar(&Offline, "offline", Offline, "fail instead of downloading if nothing is cached")
+	fs.BoolVar(&listCacheRequested, "list-cache", listCacheRequested, "list cached archives and exit")
+}
+
+// ListCacheRequested reports whether --list-cache was passed to the
+// FlagSet most recently populated via RegisterFlags.
+func ListCacheRequested() bool {
+	return listCacheRequested
+}
+
+// PrintCacheList writes a human-readable listing of ListCache's entries to
+// w, for the --list-cache flag.
+func PrintCacheList(w io.Writer) error {
+	entries, err := ListCache()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "cache is empty")
+		return nil
+	}
+	for _, entry := range entries {
+		channel := entry.Channel
+		if channel == "" {
+			channel = "-"
+		}
+		version := entry.Version
+		if version == "" {
+			version = "-"
+		} else {
+			version = fmt.Sprintf("%s-%d", version, entry.BuildNumber)
+		}
+		fmt.Fprintf(w, "%s\t%d bytes\t%s\t%s\t%s\n", entry.Sha256, entry.SizeBytes, channel, version, entry.URL)
+	}
+	return nil
+}
@@ -3,19 +3,25 @@ package cmd
 import (
 	"archive/tar"
 	"archive/zip"
-	"bytes"
 	"compress/bzip2"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,9 +42,208 @@ func targetExeFilename(exeName string) string {
 	return targetFileName
 }
 
-func InstallMicromamba() (string, error) {
+const (
+	netrcEnvVar           = "ENSURECONDA_NETRC"
+	bearerTokenEnvVar     = "ENSURECONDA_BEARER_TOKEN"
+	bearerTokenHostEnvVar = "ENSURECONDA_BEARER_TOKEN_HOST"
+	caBundleEnvVar        = "ENSURECONDA_CA_BUNDLE"
+	httpClientTimeout     = 5 * time.Minute
+)
+
+// httpClient builds an *http.Client honoring HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+// and ENSURECONDA_CA_BUNDLE.
+func httpClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+
+	if caBundlePath := os.Getenv(caBundleEnvVar); caBundlePath != "" {
+		pemData, err := ioutil.ReadFile(caBundlePath)
+		pool := x509.NewCertPool()
+		if err == nil && pool.AppendCertsFromPEM(pemData) {
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		} else {
+			log.WithField("path", caBundlePath).Warn("could not load ENSURECONDA_CA_BUNDLE, falling back to system roots")
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   httpClientTimeout,
+	}
+}
+
+// applyAuth attaches credentials to req from ENSURECONDA_BEARER_TOKEN (scoped
+// to bearerTokenHost()) or ENSURECONDA_NETRC, in that order of precedence.
+func applyAuth(req *http.Request) error {
+	if token := os.Getenv(bearerTokenEnvVar); token != "" {
+		if host := bearerTokenHost(); host != "" && strings.EqualFold(host, req.URL.Hostname()) {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}
+	}
+
+	if netrcPath := os.Getenv(netrcEnvVar); netrcPath != "" {
+		username, password, err := netrcCredentialsForHost(netrcPath, req.URL.Hostname())
+		if err != nil {
+			return err
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	return nil
+}
+
+// bearerTokenHost returns ENSURECONDA_BEARER_TOKEN_HOST, or else the host of
+// ENSURECONDA_CONDA_STANDALONE_CHANNEL_URL.
+func bearerTokenHost() string {
+	if host := os.Getenv(bearerTokenHostEnvVar); host != "" {
+		return host
+	}
+	if channelURL := os.Getenv(condaStandaloneChannelURLEnvVar); channelURL != "" {
+		if u, err := url.Parse(channelURL); err == nil {
+			return u.Hostname()
+		}
+	}
+	return ""
+}
+
+// netrcCredentialsForHost does a minimal parse of a .netrc-style file,
+// looking for a "machine <host>" entry and its "login"/"password" fields.
+func netrcCredentialsForHost(path string, host string) (string, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(string(data))
+	var username, password string
+	matched := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				matched = fields[i+1] == host
+			}
+		case "login":
+			if matched && i+1 < len(fields) {
+				username = fields[i+1]
+			}
+		case "password":
+			if matched && i+1 < len(fields) {
+				password = fields[i+1]
+			}
+		}
+	}
+
+	return username, password, nil
+}
+
+// httpGet performs an authenticated GET via httpClient, retrying on
+// connection errors and 5xx responses.
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	var resp *http.Response
+	client := httpClient()
+	r := retry.NewRetrier(5, 200*time.Millisecond, 10*time.Second)
+
+	err := r.Run(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if err := applyAuth(req); err != nil {
+			return err
+		}
+
+		resp, err = client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			return fmt.Errorf("server error fetching %s: %s", url, resp.Status)
+		}
+		return nil
+	})
+
+	return resp, err
+}
+
+// NoVerify disables checksum verification of downloaded archives. It is
+// wired up to the --no-verify CLI flag.
+var NoVerify bool
+
+// micromambaSha256EnvVar lets users pin the expected sha256 of the
+// micromamba archive fetched from the /latest endpoint, which does not
+// advertise a hash of its own.
+const micromambaSha256EnvVar = "ENSURECONDA_MICROMAMBA_SHA256"
+
+// Artifact is the resolved, downloadable representation of a tool build.
+// Channel, Version, and BuildNumber may be empty if Resolve couldn't
+// determine them ahead of the download, as with micromamba's /latest.
+type Artifact struct {
+	URL         string
+	Sha256      string
+	Channel     string
+	Version     string
+	BuildNumber int32
+}
+
+// Installer resolves and installs a single tool. Implementations are
+// registered with RegisterInstaller.
+type Installer interface {
+	Name() string
+	Resolve(ctx context.Context) (Artifact, error)
+	Install(ctx context.Context, artifact Artifact) (string, error)
+}
+
+var installers = map[string]Installer{}
+
+// RegisterInstaller makes i available to InstallTool under i.Name(). Later
+// registrations for the same name replace earlier ones.
+func RegisterInstaller(i Installer) {
+	installers[i.Name()] = i
+}
+
+// InstallTool resolves and installs the tool registered under name, returning
+// the path to the installed executable.
+func InstallTool(name string) (string, error) {
+	i, ok := installers[name]
+	if !ok {
+		return "", fmt.Errorf("no installer registered for %q", name)
+	}
+	ctx := context.Background()
+	artifact, err := i.Resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	return i.Install(ctx, artifact)
+}
+
+func init() {
+	RegisterInstaller(micromambaInstaller{})
+	RegisterInstaller(condaStandaloneInstaller{})
+}
+
+type micromambaInstaller struct{}
+
+func (micromambaInstaller) Name() string { return "micromamba" }
+
+func (micromambaInstaller) Resolve(ctx context.Context) (Artifact, error) {
 	url := fmt.Sprintf("https://micro.mamba.pm/api/micromamba/%s/latest", PlatformSubdir())
-	return installMicromamba(url)
+	return Artifact{URL: url, Sha256: os.Getenv(micromambaSha256EnvVar)}, nil
+}
+
+func (micromambaInstaller) Install(ctx context.Context, artifact Artifact) (string, error) {
+	return installMicromamba(ctx, artifact)
+}
+
+// InstallMicromamba is a thin wrapper around the registered micromamba
+// Installer, kept for backwards compatibility.
+func InstallMicromamba() (string, error) {
+	return InstallTool("micromamba")
 }
 
 type AnacondaPkgAttr struct {
@@ -53,6 +258,8 @@ type AnacondaPkg struct {
 	Type        string          `json:"type"`
 	Version     string          `json:"version"`
 	DownloadUrl string          `json:"download_url"`
+	Sha256      string          `json:"sha256"`
+	Md5         string          `json:"md5"`
 }
 
 type AnacondaPkgs []AnacondaPkg
@@ -98,50 +305,156 @@ func getChannelName() (string, error) {
 	return channel, nil
 }
 
-func InstallCondaStandalone() (string, error) {
-	// Get the most recent conda-standalone
+// condaStandaloneChannelURLEnvVar, when set, points at a standard conda
+// channel (e.g. conda-forge, an internal mirror, or a Gitea/Artifactory
+// conda registry) to use instead of the anaconda.org package API.
+const condaStandaloneChannelURLEnvVar = "ENSURECONDA_CONDA_STANDALONE_CHANNEL_URL"
+
+// CondaPackageRecord is a single entry from a standard conda channel's
+// repodata.json, restricted to the fields we need to pick and fetch a
+// conda-standalone build.
+type CondaPackageRecord struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	BuildNumber int32  `json:"build_number"`
+	Timestamp   uint64 `json:"timestamp"`
+	Sha256      string `json:"sha256"`
+	Md5         string `json:"md5"`
+}
+
+// CondaRepodata is the subset of a channel subdir's repodata.json that we
+// parse. Entries may appear under either "packages" (.tar.bz2) or
+// "packages.conda" (.conda), keyed by filename.
+type CondaRepodata struct {
+	Packages      map[string]CondaPackageRecord `json:"packages"`
+	PackagesConda map[string]CondaPackageRecord `json:"packages.conda"`
+}
+
+type condaStandaloneInstaller struct{}
+
+func (condaStandaloneInstaller) Name() string { return "conda-standalone" }
+
+func (condaStandaloneInstaller) Resolve(ctx context.Context) (Artifact, error) {
 	subdir := PlatformSubdir()
-	channel, err := getChannelName()
-	if err != nil {
-		return "", err
-	}
 
-	candidates, err := computeCandidates(channel, subdir)
+	var candidates []AnacondaPkg
+	var channelLabel string
+	var err error
+	if channelURL := os.Getenv(condaStandaloneChannelURLEnvVar); channelURL != "" {
+		channelURL = strings.TrimRight(channelURL, "/")
+		channelLabel = channelURL
+		candidates, err = computeCandidatesFromChannel(ctx, channelURL, subdir)
+	} else {
+		channelLabel, err = getChannelName()
+		if err == nil {
+			candidates, err = computeCandidates(ctx, channelLabel, subdir)
+		}
+	}
 	if err != nil {
-		return "", err
+		return Artifact{}, err
 	}
 	chosen := candidates[len(candidates)-1]
 
-	downloadUrl := "https:" + chosen.DownloadUrl
-	installedExe, err := downloadAndUnpackArchive(
-		downloadUrl, map[string]string{
+	downloadUrl := chosen.DownloadUrl
+	if !strings.Contains(downloadUrl, "://") {
+		downloadUrl = "https:" + downloadUrl
+	}
+	return Artifact{
+		URL:         downloadUrl,
+		Sha256:      chosen.Sha256,
+		Channel:     channelLabel,
+		Version:     chosen.Version,
+		BuildNumber: chosen.Attrs.BuildNumber,
+	}, nil
+}
+
+func (condaStandaloneInstaller) Install(ctx context.Context, artifact Artifact) (string, error) {
+	return downloadAndUnpackArchive(
+		ctx, artifact, map[string]string{
 			"standalone_conda/conda.exe": targetExeFilename("conda_standalone"),
 		})
+}
 
-	return installedExe, err
+// InstallCondaStandalone is a thin wrapper around the registered
+// conda-standalone Installer, kept for backwards compatibility.
+func InstallCondaStandalone() (string, error) {
+	return InstallTool("conda-standalone")
+}
+
+// computeCandidatesFromChannel fetches <baseURL>/<subdir>/repodata.json from
+// a standard conda channel and returns the sorted list of conda-standalone
+// packages it offers for subdir, in the same order computeCandidates does.
+func computeCandidatesFromChannel(ctx context.Context, baseURL string, subdir string) ([]AnacondaPkg, error) {
+	url := fmt.Sprintf("%s/%s/repodata.json", baseURL, subdir)
+
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var repodata CondaRepodata
+	if err := json.Unmarshal(body, &repodata); err != nil {
+		return nil, err
+	}
+
+	var candidates = make([]AnacondaPkg, 0)
+	for filename, record := range repodata.Packages {
+		if record.Name == "conda-standalone" {
+			candidates = append(candidates, anacondaPkgFromRecord(record, subdir, baseURL, filename))
+		}
+	}
+	for filename, record := range repodata.PackagesConda {
+		if record.Name == "conda-standalone" {
+			candidates = append(candidates, anacondaPkgFromRecord(record, subdir, baseURL, filename))
+		}
+	}
+	sort.Sort(AnacondaPkgs(candidates))
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("No conda-standalone found for %s at %s", subdir, baseURL)
+	}
+	return candidates, nil
+}
+
+func anacondaPkgFromRecord(record CondaPackageRecord, subdir string, baseURL string, filename string) AnacondaPkg {
+	return AnacondaPkg{
+		Version: record.Version,
+		Attrs: AnacondaPkgAttr{
+			Subdir:      subdir,
+			BuildNumber: record.BuildNumber,
+			Timestamp:   record.Timestamp,
+		},
+		DownloadUrl: fmt.Sprintf("%s/%s/%s", baseURL, subdir, filename),
+		Sha256:      record.Sha256,
+		Md5:         record.Md5,
+	}
 }
 
 // computeCandidates returns the sorted list of available conda-standalone
 // packages for the given channel and subdir (ascending by version/build/timestamp).
-func computeCandidates(channel string, subdir string) ([]AnacondaPkg, error) {
+func computeCandidates(ctx context.Context, channel string, subdir string) ([]AnacondaPkg, error) {
 	url := fmt.Sprintf("https://api.anaconda.org/package/%s/conda-standalone/files", channel)
 
-	resp, err := http.Get(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
-
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	var data []AnacondaPkg
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		panic(err.Error())
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
 	}
 
 	var candidates = make([]AnacondaPkg, 0)
@@ -167,51 +480,378 @@ func inferArchiveTypeFromUrl(url string) ArchiveType {
 	return UnrecognizedArchive
 }
 
-func downloadAndUnpackArchive(url string, fileNameMap map[string]string) (string, error) {
-	archiveType := inferArchiveTypeFromUrl(url)
-
-	switch archiveType {
+func downloadAndUnpackArchive(ctx context.Context, artifact Artifact, fileNameMap map[string]string) (string, error) {
+	switch inferArchiveTypeFromUrl(artifact.URL) {
 	case TarBz2Archive:
-		return downloadAndUnpackTarBz2(url, fileNameMap)
+		return downloadAndUnpackTarBz2(ctx, artifact, fileNameMap)
 	case CondaArchive:
-		return downloadAndUnpackConda(url, fileNameMap)
+		return downloadAndUnpackConda(ctx, artifact, fileNameMap)
 	default:
-		return "", errors.New("Unrecognized archive type " + url)
+		return "", errors.New("Unrecognized archive type " + artifact.URL)
+	}
+}
+
+// ShowProgress enables a progress sink while downloading an archive. It is
+// wired up to the --progress CLI flag.
+var ShowProgress bool
+
+// progressWriter logs download progress to stderr as bytes are written to
+// it. It is meant to be combined with the real destination writer via
+// io.MultiWriter.
+type progressWriter struct {
+	total   int64
+	written int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.total > 0 {
+		fmt.Fprintf(os.Stderr, "\rdownloading... %d%%", w.written*100/w.total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\rdownloading... %d bytes", w.written)
+	}
+	return len(p), nil
+}
+
+// newProgressWriter returns a writer that reports download progress to
+// stderr, or nil if ShowProgress is disabled.
+func newProgressWriter(total int64) io.Writer {
+	if !ShowProgress {
+		return nil
+	}
+	return &progressWriter{total: total}
+}
+
+// Refresh forces a redownload of the archive even if a cached copy exists.
+// It is wired up to the --refresh CLI flag.
+var Refresh bool
+
+// Offline fails fast instead of downloading when nothing is cached. It is
+// wired up to the --offline CLI flag.
+var Offline bool
+
+// cacheMaxSizeEnvVar bounds the total size of the archives in cacheDir(); the oldest entries
+// (by last access) are evicted first once it's exceeded.
+const cacheMaxSizeEnvVar = "ENSURECONDA_CACHE_MAX_SIZE"
+
+func cacheDir() string {
+	dir := filepath.Join(sitePath(), "cache")
+	_ = os.MkdirAll(dir, 0700)
+	return dir
+}
+
+// cacheSidecar is stored alongside each cached archive as "<path>.json" so
+// `ensureconda --list-cache` can show what's there without re-deriving it
+// from the archive itself.
+type cacheSidecar struct {
+	URL         string `json:"url"`
+	Sha256      string `json:"sha256"`
+	Channel     string `json:"channel,omitempty"`
+	Version     string `json:"version,omitempty"`
+	BuildNumber int32  `json:"build_number,omitempty"`
+}
+
+func cacheSidecarPath(archivePath string) string {
+	return archivePath + ".json"
+}
+
+func writeCacheSidecar(archivePath string, artifact Artifact, sha256sum string) error {
+	sidecar := cacheSidecar{
+		URL:         artifact.URL,
+		Sha256:      sha256sum,
+		Channel:     artifact.Channel,
+		Version:     artifact.Version,
+		BuildNumber: artifact.BuildNumber,
+	}
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheSidecarPath(archivePath), data, 0600)
+}
+
+// CacheEntry describes one archive sitting in the local cache, for
+// `ensureconda --list-cache`.
+type CacheEntry struct {
+	URL         string
+	Sha256      string
+	Channel     string
+	Version     string
+	BuildNumber int32
+	SizeBytes   int64
+	ArchivePath string
+}
+
+// ListCache returns the archives currently sitting in the local cache.
+func ListCache() ([]CacheEntry, error) {
+	sidecars, err := filepath.Glob(filepath.Join(cacheDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, sidecarPath := range sidecars {
+		archivePath := strings.TrimSuffix(sidecarPath, ".json")
+		info, err := os.Stat(archivePath)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(sidecarPath)
+		if err != nil {
+			continue
+		}
+		var sidecar cacheSidecar
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			URL:         sidecar.URL,
+			Sha256:      sidecar.Sha256,
+			Channel:     sidecar.Channel,
+			Version:     sidecar.Version,
+			BuildNumber: sidecar.BuildNumber,
+			SizeBytes:   info.Size(),
+			ArchivePath: archivePath,
+		})
+	}
+	return entries, nil
+}
+
+// evictCacheIfNeeded removes the least-recently-used cached archives (and
+// their sidecars) until the cached archives in cacheDir() total at most
+// ENSURECONDA_CACHE_MAX_SIZE bytes.
+func evictCacheIfNeeded() {
+	maxSize, err := strconv.ParseInt(os.Getenv(cacheMaxSizeEnvVar), 10, 64)
+	if err != nil || maxSize <= 0 {
+		return
+	}
+	evictOldestUntilUnderSize(cacheDir(), maxSize)
+}
+
+// evictOldestUntilUnderSize removes the least-recently-used archives (and
+// their sidecars) under dir, oldest mtime first, until the archives' total
+// size is at most maxSize. Only archives that have a sidecar are counted;
+// the sidecars themselves are not.
+func evictOldestUntilUnderSize(dir string, maxSize int64) {
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	type cachedFile struct {
+		archivePath string
+		size        int64
+		accessedAt  time.Time
+	}
+	var files []cachedFile
+	var total int64
+	for _, sidecarPath := range sidecars {
+		archivePath := strings.TrimSuffix(sidecarPath, ".json")
+		info, err := os.Stat(archivePath)
+		if err != nil {
+			continue
+		}
+		files = append(files, cachedFile{archivePath: archivePath, size: info.Size(), accessedAt: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].accessedAt.Before(files[j].accessedAt) })
+
+	for _, f := range files {
+		if total <= maxSize {
+			break
+		}
+		log.WithField("path", f.archivePath).Debug("evicting cached archive")
+		os.Remove(f.archivePath)
+		os.Remove(cacheSidecarPath(f.archivePath))
+		total -= f.size
+	}
+}
+
+// cacheKeyFor returns the content-address used to name a cached archive:
+// expectedSha256 when known, otherwise the sha256 of the URL itself.
+func cacheKeyFor(url string, expectedSha256 string) string {
+	if expectedSha256 != "" {
+		return strings.ToLower(expectedSha256)
 	}
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+// isFloatingPointerURL reports whether url is a "latest"-style endpoint that
+// can resolve to different content on every request, like micromamba's
+// /latest.
+func isFloatingPointerURL(url string) bool {
+	return strings.HasSuffix(url, "/latest")
 }
 
-func downloadAndUnpackTarBz2(url string, fileNameMap map[string]string) (string, error) {
-	resp, err := http.Get(url)
+// fetchArchive returns the path to a local copy of the archive at url,
+// serving it out of cacheDir() when possible. Floating pointer URLs with no
+// known hash are downloaded fresh into a temp file instead; the returned
+// cleanup func removes that temp file once the caller is done with it.
+func fetchArchive(ctx context.Context, artifact Artifact) (archivePath string, cleanup func(), err error) {
+	url := artifact.URL
+	expectedSha256 := artifact.Sha256
+	cleanup = func() {}
+
+	if expectedSha256 == "" && isFloatingPointerURL(url) {
+		if Offline {
+			return "", cleanup, fmt.Errorf("offline mode: won't re-resolve floating URL %s", url)
+		}
+		tmpFile, tmpErr := ioutil.TempFile("", "ensureconda-*"+filepath.Ext(url))
+		if tmpErr != nil {
+			return "", cleanup, tmpErr
+		}
+		tmpFile.Close()
+		archivePath = tmpFile.Name()
+		cleanup = func() { os.Remove(archivePath) }
+
+		if _, err := downloadArchive(ctx, artifact, archivePath); err != nil {
+			cleanup()
+			return "", func() {}, err
+		}
+		return archivePath, cleanup, nil
+	}
+
+	archivePath = filepath.Join(cacheDir(), cacheKeyFor(url, expectedSha256)+filepath.Ext(url))
+
+	if _, err := os.Stat(archivePath); err == nil && !Refresh {
+		now := time.Now()
+		_ = os.Chtimes(archivePath, now, now)
+		return archivePath, cleanup, nil
+	}
+
+	if Offline {
+		return "", cleanup, fmt.Errorf("offline mode: no cached archive for %s", url)
+	}
+
+	// Guard the download against other ensureconda processes racing on the
+	// same cache entry (e.g. a CI matrix sharing a cache dir), the same way
+	// extractTarFile guards concurrent writers to an extracted file.
+	fileLock := flock.New(archivePath + ".lock")
+	r := retry.NewRetrier(30, 500*time.Millisecond, 10*time.Second)
+	var actual string
+	err = r.Run(func() error {
+		locked, lockErr := fileLock.TryLock()
+		if lockErr != nil {
+			return lockErr
+		}
+		if !locked {
+			return errors.New("could not lock cache entry")
+		}
+		defer fileLock.Unlock()
+
+		// Another process may have populated the cache while we waited.
+		if _, statErr := os.Stat(archivePath); statErr == nil && !Refresh {
+			now := time.Now()
+			_ = os.Chtimes(archivePath, now, now)
+			return nil
+		}
+
+		downloaded, downloadErr := downloadArchive(ctx, artifact, archivePath)
+		if downloadErr != nil {
+			return downloadErr
+		}
+		actual = downloaded
+		return nil
+	})
+	if err != nil {
+		return "", cleanup, err
+	}
+
+	if actual != "" {
+		if err := writeCacheSidecar(archivePath, artifact, actual); err != nil {
+			log.WithError(err).Warn("could not write cache metadata")
+		}
+		evictCacheIfNeeded()
+	}
+
+	return archivePath, cleanup, nil
+}
+
+// downloadArchive downloads artifact.URL to destPath (verifying it against
+// artifact.Sha256 when known) and returns its actual sha256.
+func downloadArchive(ctx context.Context, artifact Artifact, destPath string) (string, error) {
+	url := artifact.URL
+	expectedSha256 := artifact.Sha256
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	bzf := bzip2.NewReader(resp.Body)
-	tarReader := tar.NewReader(bzf)
-	file, err := extractTarFiles(tarReader, fileNameMap)
-	return file, err
+	partialPath := destPath + ".partial"
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	var reader io.Reader = resp.Body
+	hasher := sha256.New()
+	reader = io.TeeReader(reader, hasher)
+
+	var writer io.Writer = partial
+	if progress := newProgressWriter(resp.ContentLength); progress != nil {
+		writer = io.MultiWriter(partial, progress)
+	}
+
+	_, copyErr := io.Copy(writer, reader)
+	closeErr := partial.Close()
+	if copyErr != nil {
+		os.Remove(partialPath)
+		return "", copyErr
+	}
+	if closeErr != nil {
+		os.Remove(partialPath)
+		return "", closeErr
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if expectedSha256 != "" && !NoVerify && !strings.EqualFold(actual, expectedSha256) {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", url, expectedSha256, actual)
+	}
+
+	if err := os.Rename(partialPath, destPath); err != nil {
+		return "", err
+	}
+	return actual, nil
 }
 
-func downloadAndUnpackConda(url string, fileNameMap map[string]string) (string, error) {
-	resp, err := http.Get(url)
+func downloadAndUnpackTarBz2(ctx context.Context, artifact Artifact, fileNameMap map[string]string) (string, error) {
+	archivePath, cleanup, err := fetchArchive(ctx, artifact)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	defer cleanup()
 
-	// Read the response body into a byte slice
-	body, err := ioutil.ReadAll(resp.Body)
+	f, err := os.Open(archivePath)
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
-	byteReader := bytes.NewReader(body)
+	bzf := bzip2.NewReader(f)
+	tarReader := tar.NewReader(bzf)
+	file, err := extractTarFiles(tarReader, fileNameMap)
+	return file, err
+}
+
+// downloadAndUnpackConda unpacks a .conda archive (a zip of a zstd-
+// compressed tarball) straight from its cached, on-disk location. zip needs
+// random access, which is exactly what fetchArchive's cached file gives us.
+func downloadAndUnpackConda(ctx context.Context, artifact Artifact, fileNameMap map[string]string) (string, error) {
+	archivePath, cleanup, err := fetchArchive(ctx, artifact)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
 
-	zipReader, err := zip.NewReader(byteReader, int64(len(body)))
+	zipReader, err := zip.OpenReader(archivePath)
 	if err != nil {
 		return "", err
 	}
+	defer zipReader.Close()
 
 	for _, f := range zipReader.File {
 		if strings.HasPrefix(f.Name, "pkg-conda-standalone") && strings.HasSuffix(f.Name, ".tar.zst") {
@@ -235,9 +875,9 @@ func downloadAndUnpackConda(url string, fileNameMap map[string]string) (string,
 	return "", errors.New("could not find pkg-conda-standalone*.tar.zst file in the .conda archive")
 }
 
-func installMicromamba(url string) (string, error) {
+func installMicromamba(ctx context.Context, artifact Artifact) (string, error) {
 	installedExe, err := downloadAndUnpackArchive(
-		url, map[string]string{
+		ctx, artifact, map[string]string{
 			"Library/bin/micromamba.exe": targetExeFilename("micromamba"),
 			"bin/micromamba":             targetExeFilename("micromamba"),
 		})
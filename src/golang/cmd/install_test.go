@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheKeyFor(t *testing.T) {
+	t.Run("known sha256 is used as-is, lowercased", func(t *testing.T) {
+		got := cacheKeyFor("https://example.com/conda.exe", "ABCDEF0123456789")
+		if want := "abcdef0123456789"; got != want {
+			t.Errorf("cacheKeyFor = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unknown sha256 falls back to a deterministic hash of the URL", func(t *testing.T) {
+		url := "https://micro.mamba.pm/api/micromamba/linux-64/latest"
+		got := cacheKeyFor(url, "")
+		if got == "" {
+			t.Fatal("cacheKeyFor returned an empty key")
+		}
+		if got != cacheKeyFor(url, "") {
+			t.Error("cacheKeyFor is not deterministic for the same URL")
+		}
+		if got == cacheKeyFor(url+"2", "") {
+			t.Error("cacheKeyFor should differ for different URLs")
+		}
+	})
+}
+
+func TestIsFloatingPointerURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want bool
+	}{
+		{"https://micro.mamba.pm/api/micromamba/linux-64/latest", true},
+		{"https://repo.anaconda.com/pkgs/main/linux-64/conda-4.12.0.tar.bz2", false},
+		{"https://repo.anaconda.com/pkgs/main/linux-64/conda-4.12.0.conda", false},
+	}
+
+	for _, tc := range cases {
+		if got := isFloatingPointerURL(tc.url); got != tc.want {
+			t.Errorf("isFloatingPointerURL(%q) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestEvictOldestUntilUnderSize(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name string, size int, age time.Duration) {
+		archivePath := filepath.Join(dir, name)
+		if err := os.WriteFile(archivePath, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cacheSidecarPath(archivePath), []byte(`{"url":"x"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(archivePath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("oldest", 100, 3*time.Hour)
+	write("middle", 100, 2*time.Hour)
+	write("newest", 100, 1*time.Hour)
+
+	evictOldestUntilUnderSize(dir, 150)
+
+	for _, name := range []string{"oldest", "middle"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be evicted, stat err = %v", name, err)
+		}
+		if _, err := os.Stat(cacheSidecarPath(filepath.Join(dir, name))); !os.IsNotExist(err) {
+			t.Errorf("expected %q's sidecar to be evicted, stat err = %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "newest")); err != nil {
+		t.Errorf("expected %q to survive eviction: %v", "newest", err)
+	}
+}